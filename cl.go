@@ -2,7 +2,6 @@ package main
 
 // TODO
 // - add/remove/move modules in config too
-// - remove `os.Chdir`s
 // - support for building standalone file (new and legacy)
 
 import (
@@ -17,7 +16,8 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/bmatcuk/doublestar"
+
+	"github.com/timjs/cl-go/internal/depgraph"
 )
 
 // Constants ///////////////////////////////////////////////////////////////////
@@ -35,8 +35,10 @@ Commands:
     unlit               Unliterate modules
     build               Compile project
     run                 Build and run project
-    clean               Clean build files
-    prune               Clean and remove artifacts
+    fetch               Resolve and download dependencies into Project.lock
+    test                Compile and run tests under the test directory
+    release             Cross-compile and package a release
+    clean               Clean build files (-i, -cache, -testcache, -modcache, -r, -n, -x)
 
 Legacy commands:
     add, create         Add new instance and definition modules
@@ -162,9 +164,11 @@ var (
 //NOTE: Nested structs don't have a constructor, so we define them all seperately
 type (
 	Manifest struct {
-		Project    ProjectInfo
-		Executable ExecutableInfo
-		// Dependencies map[string]string //map[name]version
+		Project      ProjectInfo
+		Executable   ExecutableInfo
+		Release      []ReleaseInfo     `toml:",omitempty"`
+		Dependencies map[string]string `toml:",omitempty"` //map[name]constraint, e.g. "Platform" -> "^1.0"
+		Replace      map[string]string `toml:",omitempty"` //map[name]path, for local development
 		// Executables []ExecutableInfo
 		// Libraries []LibraryInfo
 	}
@@ -176,9 +180,8 @@ type (
 
 		Sourcedir string `toml:",omitempty"` //Default: "src"
 
-		Modules      []string //FIXME: Should move to LibraryInfo
-		OtherModules []string //FIXME: Should move to LibraryInfo
-		Libraries    []string //FIXME: Should move to Dependencies
+		Libraries []string //FIXME: Should move to Dependencies
+		Registry  string   `toml:",omitempty"` //Default: "https://github.com/clean-lang-libraries/%s.git", overridden by CL_REGISTRY
 	}
 
 	ExecutableInfo struct {
@@ -214,19 +217,86 @@ var DefaultManifest = Manifest{
 // Project /////////////////////////////////////////////////////////////////////
 
 type Project struct {
+	Root     string // absolute directory containing Project.toml
 	Manifest Manifest
+	Lock     *Lockfile // nil if no Project.lock is present yet
+}
+
+// findProjectRoot searches for a Project.toml starting at dir and walking
+// up through its parents until one is found or the filesystem root is hit,
+// à la `go`'s module root discovery.
+func findProjectRoot(dir string) (string, error) {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, projectFileName)); err == nil {
+			return dir, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no %s found in %s or any parent directory", quote(projectFileName), dir)
+		}
+		dir = parent
+	}
 }
 
-func NewProject() Project {
+// sourcedir returns the absolute path of the project's source directory.
+func (prj *Project) sourcedir() string {
+	return filepath.Join(prj.Root, prj.Manifest.Project.Sourcedir)
+}
+
+// path joins elems onto the project root, giving an absolute path so
+// commands no longer need to `os.Chdir` into the project directory first.
+func (prj *Project) path(elem ...string) string {
+	return filepath.Join(append([]string{prj.Root}, elem...)...)
+}
+
+// NewProject locates the project root by walking up from the current
+// directory and reads its project file. If a Project.lock is present it is
+// loaded too; when it is stale relative to Project.toml, NewProject refuses
+// to continue unless frozen is false, in which case it only warns (run
+// `cl fetch` to bring it up to date).
+func NewProject(frozen bool) Project {
+	wd, err := os.Getwd()
+	expect(err, "Could not get current directory")
+
+	root, err := findProjectRoot(wd)
+	expect(err, "Could not find a project file, run `cl init` to initialise a project")
+
 	actionLog.Println("Reading project file")
 
-	file, err := os.Open(projectFileName)
+	manifest, err := readManifest(root)
+	expect(err, "Could not read project file")
+
+	lock, err := loadLockfile(root)
+	if err != nil {
+		warningLog.Println("Could not read", quote(lockFileName), err)
+	}
+	if lock != nil && lockfileStale(root, manifest, lock) {
+		if frozen {
+			errorLog.Fatalln("Project.lock is out of date, run `cl fetch` or pass --frozen=false")
+		}
+		warningLog.Println("Project.lock is out of date, run `cl fetch` to update it")
+	}
+
+	return Project{root, manifest, lock}
+}
+
+// readManifest reads and parses the Project.toml at root, filling in the
+// same defaults NewProject applies. It is also used to load a replaced
+// library's own manifest when recursing, since that manifest's Executable
+// (and everything else) belongs to the library, not the parent project.
+func readManifest(root string) (Manifest, error) {
+	file, err := os.Open(filepath.Join(root, projectFileName))
+	if err != nil {
+		return Manifest{}, err
+	}
 	defer file.Close()
-	expect(err, "Could not find a project file, run `cl init` to initialise a project")
 
 	manifest := DefaultManifest
 	md, err := toml.DecodeReader(file, &manifest)
-	expect(err, "Could not parse project file")
+	if err != nil {
+		return Manifest{}, err
+	}
 
 	if keys := md.Undecoded(); len(keys) > 0 {
 		warningLog.Println("Found undecoded keys, please update your project file:", keys)
@@ -237,7 +307,7 @@ func NewProject() Project {
 		manifest.Executable.Name = manifest.Project.Name
 	}
 
-	return Project{manifest}
+	return manifest, nil
 }
 
 func InitProject() {
@@ -272,12 +342,10 @@ func InitProject() {
 // Commands ////////////////////////////////////////////////////////////////////
 
 func (prj *Project) Add(mods ...string) {
-	os.Chdir(prj.Manifest.Project.Sourcedir)
-
 	for _, mod := range mods {
 		actionLog.Println("Creating module", quote(mod))
 
-		path := dotToSlash.Replace(mod)
+		path := filepath.Join(prj.sourcedir(), dotToSlash.Replace(mod))
 		os.MkdirAll(filepath.Dir(path), 0755)
 
 		dcl, _ := os.Create(path + ".dcl")
@@ -291,12 +359,10 @@ func (prj *Project) Add(mods ...string) {
 }
 
 func (prj *Project) Remove(mods ...string) {
-	os.Chdir(prj.Manifest.Project.Sourcedir)
-
 	for _, mod := range mods {
 		actionLog.Println("Removing module", quote(mod))
 
-		path := dotToSlash.Replace(mod)
+		path := filepath.Join(prj.sourcedir(), dotToSlash.Replace(mod))
 		os.Remove(path + ".dcl")
 		os.Remove(path + ".icl")
 	}
@@ -305,10 +371,8 @@ func (prj *Project) Remove(mods ...string) {
 func (prj *Project) Move(oldmod, newmod string) {
 	actionLog.Println("Moving", quote(oldmod), "to", quote(newmod))
 
-	os.Chdir(prj.Manifest.Project.Sourcedir)
-
-	oldpath := dotToSlash.Replace(oldmod)
-	newpath := dotToSlash.Replace(newmod)
+	oldpath := filepath.Join(prj.sourcedir(), dotToSlash.Replace(oldmod))
+	newpath := filepath.Join(prj.sourcedir(), dotToSlash.Replace(newmod))
 
 	os.MkdirAll(filepath.Dir(newpath), 0755)
 	os.Rename(oldpath+".dcl", newpath+".dcl")
@@ -318,14 +382,31 @@ func (prj *Project) Move(oldmod, newmod string) {
 func (prj *Project) Unlit() {
 	actionLog.Println("Unliterating modules")
 
-	unlitHelper(prj.Manifest.Project.Sourcedir, prj.Manifest.Executable.Main)
+	order := prj.moduleBuildOrder()
+	for _, mod := range order {
+		unlitHelper(prj.sourcedir(), mod)
+	}
+}
 
-	for _, mod := range prj.Manifest.Project.Modules {
-		unlitHelper(prj.Manifest.Project.Sourcedir, mod)
+// moduleBuildOrder discovers the modules under the project's source
+// directory and returns them topologically sorted, reachable from
+// Executable.Main. It also warns about cyclic imports and unused source
+// files along the way.
+func (prj *Project) moduleBuildOrder() []string {
+	graph, err := depgraph.Discover(prj.sourcedir())
+	expect(err, "Could not discover project modules")
+
+	root := prj.Manifest.Executable.Main
+	for _, scc := range graph.SCCs(root) {
+		warningLog.Println("Cyclic imports:", strings.Join(scc, ", "))
 	}
-	for _, mod := range prj.Manifest.Project.OtherModules {
-		unlitHelper(prj.Manifest.Project.Sourcedir, mod)
+	for _, mod := range graph.Unused(root) {
+		warningLog.Println("Unused source file for module", quote(mod))
 	}
+
+	order, err := graph.TopoSort(root)
+	expect(err, "Could not determine module build order")
+	return order
 }
 
 func unlitHelper(dir string, mod string) {
@@ -399,9 +480,10 @@ func (prj *Project) Build() {
 
 	actionLog.Println("Building project")
 
-	args := buildArgs(prj.Manifest, prj.Manifest.Executable.Main, "-o", prj.Manifest.Executable.Name)
+	args := prj.buildArgs(prj.Manifest.Executable.Main, "-o", prj.Manifest.Executable.Name)
 
 	cmd := exec.Command("clm", args...)
+	cmd.Dir = prj.Root
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	expect(cmd.Run(), "`clm` ended abnormally")
@@ -412,12 +494,12 @@ func (prj *Project) Run() {
 
 	actionLog.Println("Running project")
 
-	out := prj.Manifest.Executable.Name
-	cmd := exec.Command("./" + out)
+	cmd := exec.Command(prj.path(prj.Manifest.Executable.Name))
+	cmd.Dir = prj.Root
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	//NOTE: `cmd.Run()` lets your ignore the error and silently fails if command could not be found...
-	expect(cmd.Run(), quote(out), "ended abnormally")
+	expect(cmd.Run(), quote(prj.Manifest.Executable.Name), "ended abnormally")
 }
 
 func (prj *Project) ShowInfo() {
@@ -432,81 +514,55 @@ func (prj *Project) ShowTypes() {
 	actionLog.Println("Collecting types of functions")
 
 	now := time.Now()
-	for _, name := range prj.Manifest.Project.Modules {
-		path := filepath.Join(prj.Manifest.Project.Sourcedir, dotToSlash.Replace(name)) + ".icl"
+	for _, name := range prj.moduleBuildOrder() {
+		path := filepath.Join(prj.sourcedir(), dotToSlash.Replace(name)) + ".icl"
 		if err := os.Chtimes(path, now, now); err != nil {
 			warningLog.Println("Could not touch", path)
 		}
 	}
 
-	args := buildArgs(prj.Manifest, "-lat", prj.Manifest.Executable.Main)
+	args := prj.buildArgs("-lat", prj.Manifest.Executable.Main)
 
 	cmd := exec.Command("clm", args...)
+	cmd.Dir = prj.Root
 	debugLog.Println(cmd)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	expect(cmd.Run(), "`clm` ended abnormally")
 }
 
-func buildArgs(manifest Manifest, extra ...string) []string {
-	args := make([]string, 0, 2*len(manifest.Project.Libraries)+len(extra)) // Reserve space for possible additional arguments
+// buildArgs assembles the `clm` arguments shared by every command that
+// invokes the compiler: the source directory, the built-in libraries, and
+// the resolved paths of fetched dependencies (from Project.lock, if any),
+// followed by the command-specific extra arguments.
+func (prj *Project) buildArgs(extra ...string) []string {
+	manifest := prj.Manifest
+	nlibs := len(manifest.Project.Libraries)
+	if prj.Lock != nil {
+		nlibs += len(prj.Lock.Dependencies)
+	}
+	args := make([]string, 0, 2*nlibs+len(extra)) // Reserve space for possible additional arguments
 	args = append(args, "-dynamics")
-	args = append(args, "-I", manifest.Project.Sourcedir)
+	args = append(args, "-I", prj.sourcedir())
 	for _, lib := range manifest.Project.Libraries {
 		args = append(args, "-IL", lib)
 	}
+	if prj.Lock != nil {
+		for _, dep := range prj.Lock.Dependencies {
+			args = append(args, "-IL", dep.libraryPath())
+		}
+	}
 	args = append(args, extra...)
 	return args
 }
 
-func (prj *Project) Clean() {
-	actionLog.Println("Cleaning files")
-
-	todo := make([]string, 0, 32)
-
-	var glob []string
-	glob, _ = doublestar.Glob("**/Clean System Files/")
-	todo = append(todo, glob...)
-	glob, _ = doublestar.Glob("*-sapl")
-	todo = append(todo, glob...)
-	glob, _ = doublestar.Glob("*-www")
-	todo = append(todo, glob...)
-
-	for _, path := range todo {
-		//NOTE: Here we could also add a check if files exist, but Glob already does that.
-		infoLog.Println(path)
-		os.RemoveAll(path)
-	}
-}
-
-func (prj *Project) Prune() {
-	prj.Clean()
-
-	actionLog.Println("Pruning files")
-
-	todo := make([]string, 0, 3)
-
-	var glob []string
-	glob, _ = doublestar.Glob(prj.Manifest.Executable.Name)
-	todo = append(todo, glob...)
-	glob, _ = doublestar.Glob(legacyProjectFileName)
-	todo = append(todo, glob...)
-	glob, _ = doublestar.Glob("*-data")
-	todo = append(todo, glob...)
-
-	for _, path := range todo {
-		infoLog.Println(path)
-		os.RemoveAll(path)
-	}
-}
-
 // Legacy commands /////////////////////////////////////////////////////////////
 
 func (prj *Project) LegacyGen() {
 	actionLog.Println("Generating legacy project configuration")
 
 	temp := template.Must(template.New("legacy config").Parse(legacyConfigTemplate))
-	out, err := os.Create(legacyProjectFileName)
+	out, err := os.Create(prj.path(legacyProjectFileName))
 	defer out.Close()
 	expect(err, "Could not create", quote(legacyProjectFileName))
 
@@ -520,6 +576,7 @@ func (prj *Project) LegacyBuild() {
 	actionLog.Println("Building project")
 
 	cmd := exec.Command("cpm", legacyProjectFileName)
+	cmd.Dir = prj.Root
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	expect(cmd.Run(), "`cpm` ended abnormally")
@@ -530,11 +587,11 @@ func (prj *Project) LegacyRun() {
 
 	actionLog.Println("Running project")
 
-	out := prj.Manifest.Executable.Name
-	cmd := exec.Command("./" + out)
+	cmd := exec.Command(prj.path(prj.Manifest.Executable.Name))
+	cmd.Dir = prj.Root
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	expect(cmd.Run(), quote(out), "ended abnormally")
+	expect(cmd.Run(), quote(prj.Manifest.Executable.Name), "ended abnormally")
 }
 
 // Main ////////////////////////////////////////////////////////////////////////
@@ -552,12 +609,21 @@ func main() {
 		InitProject()
 	default:
 		// For other options we need to be in a project directory
-		prj := NewProject()
+		frozen := os.Args[1] != "fetch"
+		rest := make([]string, 0, len(os.Args)-2)
+		for _, arg := range os.Args[2:] {
+			if arg == "--frozen=false" {
+				frozen = false
+				continue
+			}
+			rest = append(rest, arg)
+		}
+		prj := NewProject(frozen)
 
 		switch os.Args[1] {
 		case "show":
-			if len(os.Args) == 3 {
-				switch os.Args[2] {
+			if len(rest) == 1 {
+				switch rest[0] {
 				case "info":
 					prj.ShowInfo()
 				case "types":
@@ -567,21 +633,25 @@ func main() {
 				prj.ShowInfo()
 			}
 		case "add", "create":
-			prj.Add(os.Args[2:]...)
+			prj.Add(rest...)
 		case "remove", "rm", "delete":
-			prj.Remove(os.Args[2:]...)
+			prj.Remove(rest...)
 		case "move", "mv":
-			prj.Move(os.Args[2], os.Args[3])
+			prj.Move(rest[0], rest[1])
 		case "unlit":
 			prj.Unlit()
 		case "build":
 			prj.Build()
 		case "run":
 			prj.Run()
+		case "fetch":
+			prj.Fetch()
+		case "test":
+			prj.Test(rest)
+		case "release":
+			prj.Release(rest)
 		case "clean":
-			prj.Clean()
-		case "prune":
-			prj.Prune()
+			prj.Clean(rest)
 		case "generate":
 			prj.LegacyGen()
 		case "legacybuild":
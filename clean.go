@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// A cleanRule is one group of glob patterns that `cl clean` may remove,
+// gated behind its own flag. Future artefact types register themselves
+// here instead of being hard-coded into Clean.
+type cleanRule struct {
+	Flag     string
+	Enabled  bool
+	Patterns []string
+}
+
+// Clean removes build artefacts, inspired by `go clean`'s flags: -i for the
+// built executable, -cache/-testcache/-modcache for the various caches, -r
+// to recurse into replaced local libraries, and -n/-x for dry-run and
+// echo-commands modes.
+func (prj *Project) Clean(args []string) {
+	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	i := flags.Bool("i", false, "remove the built executable")
+	cache := flags.Bool("cache", false, "purge the shared per-user object cache")
+	testcache := flags.Bool("testcache", false, "remove *-data directories and test build artefacts")
+	modcache := flags.Bool("modcache", false, "wipe the dependency cache populated by `cl fetch`")
+	recurse := flags.Bool("r", false, "recurse into libraries listed under [replace]")
+	dryRun := flags.Bool("n", false, "print what would be removed, without removing anything")
+	echoCmd := flags.Bool("x", false, "print each removal as it runs")
+	expect(flags.Parse(args), "Could not parse arguments")
+
+	opts := cleanOptions{
+		removeExe: *i,
+		cache:     *cache,
+		testcache: *testcache,
+		modcache:  *modcache,
+		dryRun:    *dryRun,
+		echoCmd:   *echoCmd,
+	}
+
+	reclaimed := prj.clean(opts)
+
+	if *recurse {
+		// -cache/-modcache point at the single shared per-user cache
+		// directory, not anything under a project root, so recursing into
+		// replaced libraries must not count or remove it again.
+		subOpts := opts
+		subOpts.cache = false
+		subOpts.modcache = false
+
+		for name, path := range prj.Manifest.Replace {
+			actionLog.Println("Recursing into", quote(name))
+			root := prj.path(path)
+			manifest, err := readManifest(root)
+			if err != nil {
+				warningLog.Println("Could not read project file for", quote(name), err)
+				continue
+			}
+			sub := Project{Root: root, Manifest: manifest}
+			reclaimed += sub.clean(subOpts)
+		}
+	}
+
+	actionLog.Println("Reclaimed", formatBytes(reclaimed))
+}
+
+type cleanOptions struct {
+	removeExe bool
+	cache     bool
+	testcache bool
+	modcache  bool
+	dryRun    bool
+	echoCmd   bool
+}
+
+// clean removes the artefacts for a single project root and returns the
+// number of bytes reclaimed (or that would be reclaimed, in dry-run mode).
+func (prj *Project) clean(opts cleanOptions) int64 {
+	rules := []cleanRule{
+		{Flag: "", Enabled: true, Patterns: []string{
+			prj.path("**/Clean System Files/"),
+			prj.path("*-sapl"),
+			prj.path("*-www"),
+		}},
+		{Flag: "-i", Enabled: opts.removeExe, Patterns: []string{
+			prj.path(prj.Manifest.Executable.Name),
+			prj.path(legacyProjectFileName),
+		}},
+		{Flag: "-testcache", Enabled: opts.testcache, Patterns: []string{
+			prj.path("*-data"),
+		}},
+		{Flag: "-cache", Enabled: opts.cache, Patterns: []string{
+			filepath.Join(cacheDir(), "objects"),
+		}},
+		{Flag: "-modcache", Enabled: opts.modcache, Patterns: []string{
+			filepath.Join(cacheDir(), "libs"),
+		}},
+	}
+
+	var todo []string
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		for _, pattern := range rule.Patterns {
+			matches, _ := doublestar.Glob(pattern)
+			todo = append(todo, matches...)
+		}
+	}
+
+	var reclaimed int64
+	for _, path := range todo {
+		size, _ := dirSize(path)
+		reclaimed += size
+
+		if opts.echoCmd || opts.dryRun {
+			infoLog.Println("rm -rf", path)
+		} else {
+			infoLog.Println(path)
+		}
+		if !opts.dryRun {
+			os.RemoveAll(path)
+		}
+	}
+	return reclaimed
+}
+
+// dirSize returns the total size in bytes of path, recursing if it is a
+// directory.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The split between Project.toml and Project.lock mirrors dep's go.mod and
+// go.sum: the manifest records the human-chosen constraints, the lockfile
+// records exactly what was resolved so builds are reproducible.
+const lockFileName = "Project.lock"
+
+// defaultRegistry is a URL template for a dependency's git remote; %s is
+// substituted with the dependency name. Override it per-project with
+// `registry` under `[project]` in Project.toml, or globally with the
+// CL_REGISTRY environment variable.
+const defaultRegistry = "https://github.com/clean-lang-libraries/%s.git"
+
+// registry returns the URL template to resolve dependencies against.
+func (prj *Project) registry() string {
+	if prj.Manifest.Project.Registry != "" {
+		return prj.Manifest.Project.Registry
+	}
+	if reg := os.Getenv("CL_REGISTRY"); reg != "" {
+		return reg
+	}
+	return defaultRegistry
+}
+
+type (
+	Lockfile struct {
+		Dependencies []LockedDependency
+	}
+
+	LockedDependency struct {
+		Name       string
+		Version    string
+		Constraint string // the `[dependencies]` constraint this was resolved against, e.g. "^1.0"
+		Source     string // git URL, or "path:<dir>" for a `[replace]` entry
+		Hash       string // sha256 of the materialised directory's file list and contents
+	}
+)
+
+// libraryPath returns the `-IL` argument pointing at where this dependency
+// was materialised: the local replacement directory, or the per-version
+// cache directory it was fetched into.
+func (dep LockedDependency) libraryPath() string {
+	if strings.HasPrefix(dep.Source, "path:") {
+		return strings.TrimPrefix(dep.Source, "path:")
+	}
+	return filepath.Join(cacheDir(), "libs", dep.Name, dep.Version)
+}
+
+func cacheDir() string {
+	if dir := os.Getenv("CL_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "cl-go")
+	}
+	return filepath.Join(home, ".cache", "cl-go")
+}
+
+func loadLockfile(root string) (*Lockfile, error) {
+	file, err := os.Open(filepath.Join(root, lockFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lock Lockfile
+	if _, err := toml.DecodeReader(file, &lock); err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+func (lock *Lockfile) save(root string) error {
+	file, err := os.Create(filepath.Join(root, lockFileName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := toml.NewEncoder(file)
+	enc.Indent = ""
+	return enc.Encode(lock)
+}
+
+// lockfileStale reports whether Project.lock no longer matches the
+// `[dependencies]`/`[replace]` tables in Project.toml, i.e. whether a
+// dependency was added, removed, had its constraint changed, or had its
+// `[replace]` override added, removed or repointed since the lockfile was
+// last written. root is the project root, needed to resolve `[replace]`
+// paths the same way resolveDependency does.
+func lockfileStale(root string, manifest Manifest, lock *Lockfile) bool {
+	locked := make(map[string]LockedDependency, len(lock.Dependencies))
+	for _, dep := range lock.Dependencies {
+		locked[dep.Name] = dep
+	}
+	if len(locked) != len(manifest.Dependencies) {
+		return true
+	}
+	for name, constraint := range manifest.Dependencies {
+		dep, ok := locked[name]
+		if !ok || dep.Constraint != constraint {
+			return true
+		}
+
+		wantSource, wantsReplace := replacementSource(root, manifest, name)
+		hasReplace := strings.HasPrefix(dep.Source, "path:")
+		if wantsReplace != hasReplace {
+			return true
+		}
+		if wantsReplace && dep.Source != wantSource {
+			return true
+		}
+	}
+	return false
+}
+
+// replacementSource returns the Source a `[replace]` override for name
+// would resolve to, the same way resolveDependency builds it, and whether
+// name has one at all.
+func replacementSource(root string, manifest Manifest, name string) (source string, ok bool) {
+	path, ok := manifest.Replace[name]
+	if !ok {
+		return "", false
+	}
+	return "path:" + filepath.Join(root, path), true
+}
+
+// Fetch resolves every entry in `[dependencies]` against its registry (or
+// `[replace]` override), materialises it under the local cache, and writes
+// the result to Project.lock.
+func (prj *Project) Fetch() {
+	if len(prj.Manifest.Dependencies) == 0 {
+		infoLog.Println("No dependencies to fetch")
+		return
+	}
+
+	actionLog.Println("Fetching dependencies")
+
+	names := make([]string, 0, len(prj.Manifest.Dependencies))
+	for name := range prj.Manifest.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lock := &Lockfile{}
+	for _, name := range names {
+		constraint := prj.Manifest.Dependencies[name]
+		dep, err := prj.resolveDependency(name, constraint)
+		expect(err, "Could not resolve dependency", quote(name))
+		infoLog.Println(name, dep.Version)
+		lock.Dependencies = append(lock.Dependencies, dep)
+	}
+
+	expect(lock.save(prj.Root), "Could not write", quote(lockFileName))
+	prj.Lock = lock
+}
+
+// resolveDependency resolves a single dependency, honouring a `[replace]`
+// override if one is present, or otherwise fetching the matching tag from
+// its registry into the shared cache.
+func (prj *Project) resolveDependency(name, constraint string) (LockedDependency, error) {
+	if path, ok := prj.Manifest.Replace[name]; ok {
+		abs := prj.path(path)
+		hash, err := hashDir(abs)
+		if err != nil {
+			return LockedDependency{}, err
+		}
+		return LockedDependency{Name: name, Version: "local", Constraint: constraint, Source: "path:" + abs, Hash: hash}, nil
+	}
+
+	url := fmt.Sprintf(prj.registry(), name)
+	version, err := resolveVersion(url, constraint)
+	if err != nil {
+		return LockedDependency{}, err
+	}
+
+	dest := filepath.Join(cacheDir(), "libs", name, version)
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if err := gitCheckout(url, "v"+version, dest); err != nil {
+			return LockedDependency{}, err
+		}
+	}
+
+	hash, err := hashDir(dest)
+	if err != nil {
+		return LockedDependency{}, err
+	}
+	return LockedDependency{Name: name, Version: version, Constraint: constraint, Source: url, Hash: hash}, nil
+}
+
+// resolveVersion lists the registry's tags and picks the highest version
+// satisfying constraint, a caret range like "^1.2" (same major version, or
+// same minor version if major is 0 -- the usual semver caret meaning).
+func resolveVersion(url, constraint string) (string, error) {
+	out, err := exec.Command("git", "ls-remote", "--tags", url).Output()
+	if err != nil {
+		return "", fmt.Errorf("could not list tags for %s: %w", url, err)
+	}
+
+	var best [3]int
+	found := false
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		ref := strings.TrimPrefix(fields[1], "refs/tags/")
+		v, ok := parseSemver(strings.TrimPrefix(ref, "v"))
+		if !ok || !satisfiesCaret(v, constraint) {
+			continue
+		}
+		if !found || semverLess(best, v) {
+			best = v
+			found = true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("no tag of %s satisfies %s", url, quote(constraint))
+	}
+	return fmt.Sprintf("%d.%d.%d", best[0], best[1], best[2]), nil
+}
+
+func parseSemver(s string) (v [3]int, ok bool) {
+	parts := strings.SplitN(s, ".", 3)
+	if len(parts) == 0 {
+		return v, false
+	}
+	for i, part := range parts {
+		if i >= 3 {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+func semverLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// satisfiesCaret reports whether v satisfies a caret constraint such as
+// "^1.2" or "^0.3": compatible releases share the same major version (or,
+// when the major version is 0, the same minor version) and are not lower
+// than the constraint itself. A patch-level constraint such as "^0.0.3" is
+// treated like "^0.0" and also accepts 0.0.4.
+func satisfiesCaret(v [3]int, constraint string) bool {
+	constraint = strings.TrimPrefix(strings.TrimSpace(constraint), "^")
+	min, ok := parseSemver(constraint)
+	if !ok {
+		return false
+	}
+	if semverLess(v, min) {
+		return false
+	}
+	if min[0] != 0 {
+		return v[0] == min[0]
+	}
+	return v[0] == 0 && v[1] == min[1]
+}
+
+func gitCheckout(url, tag, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	cmd := exec.Command("git", "clone", "--branch", tag, "--depth", "1", url, dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// hashDir returns a content hash over every file's relative path and
+// contents, used as a reproducibility check for the lockfile. The `.git`
+// directory left behind by `gitCheckout` is skipped: its contents (packed
+// refs, logs, index) are not deterministic across clones of the same tag.
+func hashDir(dir string) (string, error) {
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, rel)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(hash, name)
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
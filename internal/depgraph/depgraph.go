@@ -0,0 +1,371 @@
+// Package depgraph discovers Clean modules on disk and resolves the import
+// graph between them.
+//
+// It is modeled on Elm's dependency reader: Discover parses every module
+// under a source directory, and the queries then start from a single root
+// module and walk `import` statements transitively, so only modules that are
+// actually reachable from the root are ordered. This lets callers ask
+// for a build order (topological sort), detect unused source files, and
+// report strongly connected components so that mutually recursive modules
+// (which Clean permits within a single component) can be surfaced as a
+// warning instead of a hard failure.
+package depgraph
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Module is a single Clean module found under a source directory.
+type Module struct {
+	Name    string // dotted module name, e.g. "Data.Map"
+	HasIcl  bool
+	HasDcl  bool
+	HasLcl  bool
+	Imports []string // dotted names of directly imported modules
+}
+
+// Graph is the set of modules found under a source directory together with
+// their import edges.
+type Graph struct {
+	Sourcedir string
+	Modules   map[string]*Module
+}
+
+// Discover walks dir for *.icl, *.dcl and *.lcl files, parses their module
+// headers and import lines, and returns the resulting dependency graph.
+func Discover(dir string) (*Graph, error) {
+	graph := &Graph{
+		Sourcedir: dir,
+		Modules:   make(map[string]*Module),
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		if ext != ".icl" && ext != ".dcl" && ext != ".lcl" {
+			return nil
+		}
+
+		name, imports, err := parseFile(path)
+		if err != nil {
+			return fmt.Errorf("could not parse %s: %w", path, err)
+		}
+		if name == "" {
+			// Not actually a module (e.g. an empty or malformed file), skip it.
+			return nil
+		}
+
+		mod := graph.Modules[name]
+		if mod == nil {
+			mod = &Module{Name: name}
+			graph.Modules[name] = mod
+		}
+		switch ext {
+		case ".icl":
+			mod.HasIcl = true
+		case ".dcl":
+			mod.HasDcl = true
+		case ".lcl":
+			mod.HasLcl = true
+		}
+		mod.Imports = mergeImports(mod.Imports, imports)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return graph, nil
+}
+
+// Literate markers used by `.lcl` files, mirroring headerPrefix,
+// exportedPrefix and internalPrefix in cl.go: `>> module ` introduces the
+// single header that `cl`'s unliterate step expands into both
+// `definition module` and `implementation module`, `>> ` introduces a line
+// that ends up in both the .icl and .dcl, and `>  ` (two spaces) introduces
+// an .icl-only line. Everything else is prose and carries no code.
+const (
+	literateHeaderPrefix   = ">> module "
+	literateExportedPrefix = ">> "
+	literateInternalPrefix = ">  "
+)
+
+// parseFile reads the module header and import lines out of a single Clean
+// source file. `.lcl` files are literate: only lines carrying one of the
+// markers above hold code, so those are unwrapped before the usual header
+// and import matching runs.
+func parseFile(path string) (name string, imports []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	literate := filepath.Ext(path) == ".lcl"
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if literate {
+			switch {
+			case strings.HasPrefix(line, literateHeaderPrefix):
+				line = strings.TrimSpace(strings.TrimPrefix(line, literateExportedPrefix))
+			case strings.HasPrefix(line, literateExportedPrefix):
+				line = strings.TrimSpace(strings.TrimPrefix(line, literateExportedPrefix))
+			case strings.HasPrefix(line, literateInternalPrefix):
+				line = strings.TrimSpace(strings.TrimPrefix(line, literateInternalPrefix))
+			default:
+				continue // prose, not code
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(line, "definition module "):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "definition module "))
+		case strings.HasPrefix(line, "implementation module "):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "implementation module "))
+		case strings.HasPrefix(line, "module "):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "module "))
+		case strings.HasPrefix(line, "import ") || strings.HasPrefix(line, "from "):
+			imports = append(imports, parseImportLine(line)...)
+		}
+	}
+	return name, imports, scanner.Err()
+}
+
+// parseImportLine extracts the imported module names out of a Clean
+// `import` or `from ... import ...` line, ignoring `qualified` and
+// explicit import lists (`import X => f, g`, `from X import :: T`).
+func parseImportLine(line string) []string {
+	if strings.HasPrefix(line, "from ") {
+		line = strings.TrimPrefix(line, "from ")
+		if idx := strings.Index(line, " import"); idx >= 0 {
+			line = line[:idx]
+		}
+		return []string{strings.TrimSpace(line)}
+	}
+
+	line = strings.TrimPrefix(line, "import ")
+	line = strings.TrimPrefix(strings.TrimSpace(line), "qualified ")
+
+	var names []string
+	for _, part := range strings.Split(line, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		// Drop `=> f, g` explicit-import and `as Alias` qualifiers.
+		explicit := false
+		if idx := strings.IndexAny(part, "=>"); idx >= 0 {
+			part = part[:idx]
+			explicit = true
+		}
+		fields := strings.Fields(part)
+		if len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+		if explicit {
+			break // the remaining comma-separated parts name imported functions, not modules
+		}
+	}
+	return names
+}
+
+// mergeImports unions two modules' import lists, since a module's `.icl`,
+// `.dcl` and `.lcl` files are parsed separately but contribute to the same
+// Module.Imports -- e.g. a definition-only module's `.dcl` can import
+// modules its types refer to.
+func mergeImports(existing, extra []string) []string {
+	seen := make(map[string]bool, len(existing))
+	merged := make([]string, 0, len(existing)+len(extra))
+	for _, name := range existing {
+		if !seen[name] {
+			seen[name] = true
+			merged = append(merged, name)
+		}
+	}
+	for _, name := range extra {
+		if !seen[name] {
+			seen[name] = true
+			merged = append(merged, name)
+		}
+	}
+	return merged
+}
+
+// reachable returns the set of module names reachable from root, following
+// Imports edges. Imports that don't resolve to a Module found on disk (the
+// standard library, or other libraries passed to `clm` via -IL) are not
+// included, since there's no source file to build or touch for them.
+func (g *Graph) reachable(root string) map[string]bool {
+	seen := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		mod := g.Modules[name]
+		if mod == nil {
+			return
+		}
+		seen[name] = true
+		for _, imp := range mod.Imports {
+			visit(imp)
+		}
+	}
+	visit(root)
+	return seen
+}
+
+// TopoSort returns the modules reachable from root, ordered so that every
+// module appears after the modules it imports. Mutually importing modules
+// (a cycle within a single strongly connected component, which Clean
+// permits) cannot all satisfy that; among them the order is the post-order
+// of a depth-first walk started from modules in name order, so it is
+// deterministic but not alphabetical. Use SCCs to report them.
+func (g *Graph) TopoSort(root string) ([]string, error) {
+	if _, ok := g.Modules[root]; !ok {
+		return nil, fmt.Errorf("root module %s not found under %s", root, g.Sourcedir)
+	}
+	reachable := g.reachable(root)
+
+	const (
+		white = iota
+		grey
+		black
+	)
+	color := make(map[string]int, len(reachable))
+	var order []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		if color[name] != white {
+			return
+		}
+		color[name] = grey
+		if mod := g.Modules[name]; mod != nil {
+			for _, imp := range mod.Imports {
+				if !reachable[imp] {
+					continue
+				}
+				visit(imp)
+			}
+		}
+		color[name] = black
+		order = append(order, name)
+	}
+
+	names := make([]string, 0, len(reachable))
+	for name := range reachable {
+		names = append(names, name)
+	}
+	sort.Strings(names) // deterministic order when there is no dependency between modules
+
+	for _, name := range names {
+		visit(name)
+	}
+	return order, nil
+}
+
+// SCCs returns the strongly connected components of the graph restricted to
+// modules reachable from root that contain more than one module, i.e. the
+// groups of modules that mutually import each other. Clean permits this
+// within a single component, so callers should warn rather than fail.
+func (g *Graph) SCCs(root string) [][]string {
+	reachable := g.reachable(root)
+
+	// Tarjan's algorithm.
+	var (
+		index   = 0
+		indices = make(map[string]int)
+		lowlink = make(map[string]int)
+		onStack = make(map[string]bool)
+		stack   []string
+		result  [][]string
+	)
+
+	var names []string
+	for name := range reachable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var strongconnect func(name string)
+	strongconnect = func(name string) {
+		indices[name] = index
+		lowlink[name] = index
+		index++
+		stack = append(stack, name)
+		onStack[name] = true
+
+		if mod := g.Modules[name]; mod != nil {
+			for _, imp := range mod.Imports {
+				if !reachable[imp] {
+					continue
+				}
+				if _, visited := indices[imp]; !visited {
+					strongconnect(imp)
+					if lowlink[imp] < lowlink[name] {
+						lowlink[name] = lowlink[imp]
+					}
+				} else if onStack[imp] {
+					if indices[imp] < lowlink[name] {
+						lowlink[name] = indices[imp]
+					}
+				}
+			}
+		}
+
+		if lowlink[name] == indices[name] {
+			var component []string
+			for {
+				n := len(stack) - 1
+				top := stack[n]
+				stack = stack[:n]
+				onStack[top] = false
+				component = append(component, top)
+				if top == name {
+					break
+				}
+			}
+			if len(component) > 1 {
+				sort.Strings(component)
+				result = append(result, component)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, visited := indices[name]; !visited {
+			strongconnect(name)
+		}
+	}
+	return result
+}
+
+// Unused returns the modules that exist on disk but are not reachable from
+// root, i.e. source files that nothing in the dependency graph imports.
+func (g *Graph) Unused(root string) []string {
+	reachable := g.reachable(root)
+
+	var unused []string
+	for name := range g.Modules {
+		if !reachable[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
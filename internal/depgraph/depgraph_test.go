@@ -0,0 +1,137 @@
+package depgraph
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeModules creates one file per entry (path relative to dir, e.g.
+// "Foo.dcl") with the given content, and returns the directory Discover
+// should be pointed at.
+func writeModules(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDiscoverMergesImportsAcrossFileKinds(t *testing.T) {
+	// Foo only has a .dcl (a definition-only module), whose own import of
+	// Bar must still end up in the graph instead of being silently dropped.
+	dir := writeModules(t, map[string]string{
+		"Main.icl": "implementation module Main\n\nimport Foo\n",
+		"Foo.dcl":  "definition module Foo\n\nimport Bar\n",
+		"Bar.icl":  "implementation module Bar\n",
+	})
+
+	graph, err := Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo := graph.Modules["Foo"]
+	if foo == nil {
+		t.Fatal("Foo not discovered")
+	}
+	if !reflect.DeepEqual(foo.Imports, []string{"Bar"}) {
+		t.Errorf("Foo.Imports = %v, want [Bar]", foo.Imports)
+	}
+
+	order, err := graph.TopoSort("Main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"Bar", "Foo", "Main"}) {
+		t.Errorf("TopoSort(Main) = %v, want [Bar Foo Main]", order)
+	}
+
+	if unused := graph.Unused("Main"); len(unused) != 0 {
+		t.Errorf("Unused(Main) = %v, want none (Bar is a real transitive dependency)", unused)
+	}
+}
+
+func TestDiscoverParsesLiterateModules(t *testing.T) {
+	// Foo only exists as a .lcl (literate source, as produced before the
+	// first `cl build` unliterates it), and must still show up in the
+	// graph with its import intact.
+	dir := writeModules(t, map[string]string{
+		"Main.icl": "implementation module Main\n\nimport Foo\n",
+		"Foo.lcl": "Some prose introducing the module.\n\n" +
+			">> module Foo\n\n" +
+			"More prose about its imports.\n\n" +
+			">> import Bar\n" +
+			">  import Internal\n",
+		"Bar.icl": "implementation module Bar\n",
+	})
+
+	graph, err := Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo := graph.Modules["Foo"]
+	if foo == nil {
+		t.Fatal("Foo not discovered")
+	}
+	if !foo.HasLcl {
+		t.Errorf("Foo.HasLcl = false, want true")
+	}
+	if !reflect.DeepEqual(foo.Imports, []string{"Bar", "Internal"}) {
+		t.Errorf("Foo.Imports = %v, want [Bar Internal]", foo.Imports)
+	}
+
+	order, err := graph.TopoSort("Main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"Bar", "Foo", "Main"}) {
+		t.Errorf("TopoSort(Main) = %v, want [Bar Foo Main]", order)
+	}
+}
+
+func TestReachableExcludesUnresolvedImports(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"Main.icl": "implementation module Main\n\nimport StdEnv\n",
+	})
+
+	graph, err := Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := graph.TopoSort("Main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"Main"}) {
+		t.Errorf("TopoSort(Main) = %v, want [Main] (StdEnv has no source file)", order)
+	}
+}
+
+func TestSCCsReportsMutualImports(t *testing.T) {
+	dir := writeModules(t, map[string]string{
+		"Main.icl": "implementation module Main\n\nimport A\n",
+		"A.icl":    "implementation module A\n\nimport B\n",
+		"B.icl":    "implementation module B\n\nimport A\n",
+	})
+
+	graph, err := Discover(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sccs := graph.SCCs("Main")
+	if len(sccs) != 1 || !reflect.DeepEqual(sccs[0], []string{"A", "B"}) {
+		t.Errorf("SCCs(Main) = %v, want [[A B]]", sccs)
+	}
+}
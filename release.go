@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A ReleaseInfo describes a single cross-compile target in the
+// `[[release]]` array of tables in Project.toml, e.g.:
+//
+//	[[release]]
+//	target = "linux/x86_64"
+//	flags = ["-generics"]
+//	files = [{src = "README.md", dst = "README.md"}]
+type ReleaseInfo struct {
+	Target string        `toml:"target"`
+	Flags  []string      `toml:"flags,omitempty"`
+	Files  []ArchiveFile `toml:"files,omitempty"`
+}
+
+// An ArchiveFile adds an extra file to a release archive, alongside the
+// built executable.
+type ArchiveFile struct {
+	Src  string
+	Dst  string
+	Perm string `toml:",omitempty"` //Default: "0644", octal
+}
+
+const releaseDir = "dist"
+
+// Release cross-compiles the project for every target listed under
+// `[[release]]` and bundles each into a distributable archive: `.tar.gz` on
+// Unix targets, `.zip` on Windows, each next to a `.sha256` sidecar file.
+func (prj *Project) Release(args []string) {
+	flags := flag.NewFlagSet("release", flag.ExitOnError)
+	debian := flags.Bool("debian", false, "also build a Debian package for linux targets")
+	expect(flags.Parse(args), "Could not parse arguments")
+
+	if len(prj.Manifest.Release) == 0 {
+		warningLog.Println("No `[[release]]` targets configured in", quote(projectFileName))
+		return
+	}
+
+	prj.Unlit()
+
+	expect(os.MkdirAll(prj.path(releaseDir), 0755), "Could not create", quote(releaseDir))
+
+	for _, release := range prj.Manifest.Release {
+		prj.releaseTarget(release, *debian)
+	}
+}
+
+func (prj *Project) releaseTarget(release ReleaseInfo, debian bool) {
+	goos, arch, err := splitTarget(release.Target)
+	expect(err, "Invalid release target", quote(release.Target))
+
+	actionLog.Println("Building release for", quote(release.Target))
+
+	build, err := ioutil.TempDir("", "cl-release-")
+	expect(err, "Could not create build directory")
+	defer os.RemoveAll(build)
+
+	exeName := prj.Manifest.Executable.Name
+	if goos == "windows" {
+		exeName += ".exe"
+	}
+	exePath := filepath.Join(build, exeName)
+
+	clmArgs := prj.buildArgs(release.Flags...)
+	clmArgs = append(clmArgs, prj.Manifest.Executable.Main, "-o", exePath)
+
+	cmd := exec.Command("clm", clmArgs...)
+	cmd.Dir = prj.Root
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	expect(cmd.Run(), "`clm` ended abnormally for", quote(release.Target))
+
+	entries := []archiveEntry{{Src: exePath, Dst: exeName, Perm: 0755}}
+	for _, file := range release.Files {
+		perm := os.FileMode(0644)
+		if file.Perm != "" {
+			parsed, err := strconv.ParseUint(file.Perm, 8, 32)
+			expect(err, "Invalid permission", quote(file.Perm), "for", quote(file.Src))
+			perm = os.FileMode(parsed)
+		}
+		entries = append(entries, archiveEntry{Src: prj.path(file.Src), Dst: file.Dst, Perm: perm})
+	}
+
+	base := fmt.Sprintf("%s-%s-%s-%s", prj.Manifest.Project.Name, prj.Manifest.Project.Version, goos, arch)
+	var archivePath string
+	if goos == "windows" {
+		archivePath = prj.path(releaseDir, base+".zip")
+		expect(createZip(archivePath, entries), "Could not create", quote(archivePath))
+	} else {
+		archivePath = prj.path(releaseDir, base+".tar.gz")
+		expect(createTarGz(archivePath, entries), "Could not create", quote(archivePath))
+	}
+	expect(writeSHA256Sidecar(archivePath), "Could not write checksum for", quote(archivePath))
+	infoLog.Println(archivePath)
+
+	if debian && goos == "linux" {
+		prj.releaseDebian(release, arch, entries)
+	}
+}
+
+// splitTarget parses a "os/arch" target triple, e.g. "linux/x86_64".
+func splitTarget(target string) (goos, arch string, err error) {
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected <os>/<arch>, got %s", quote(target))
+	}
+	return parts[0], parts[1], nil
+}
+
+type archiveEntry struct {
+	Src  string
+	Dst  string
+	Perm os.FileMode
+}
+
+func createTarGz(archivePath string, entries []archiveEntry) error {
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(entry.Src)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name: entry.Dst,
+			Mode: int64(entry.Perm),
+			Size: int64(len(content)),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createZip(archivePath string, entries []archiveEntry) error {
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	defer zw.Close()
+
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(entry.Src)
+		if err != nil {
+			return err
+		}
+		header := &zip.FileHeader{Name: entry.Dst, Method: zip.Deflate}
+		header.SetMode(entry.Perm)
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSHA256Sidecar(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	return ioutil.WriteFile(path+".sha256", []byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))), 0644)
+}
+
+// releaseDebian lays out a minimal `DEBIAN/control` tree and invokes
+// `dpkg-deb` to build a .deb package, if it is available on PATH.
+func (prj *Project) releaseDebian(release ReleaseInfo, arch string, entries []archiveEntry) {
+	dpkgDeb, err := exec.LookPath("dpkg-deb")
+	if err != nil {
+		warningLog.Println("`dpkg-deb` not found on PATH, skipping Debian package for", quote(release.Target))
+		return
+	}
+
+	root, err := ioutil.TempDir("", "cl-debian-")
+	expect(err, "Could not create Debian package directory")
+	defer os.RemoveAll(root)
+
+	debianArch := arch
+	if debianArch == "x86_64" {
+		debianArch = "amd64"
+	}
+
+	control := fmt.Sprintf(`Package: %s
+Version: %s
+Architecture: %s
+Maintainer: %s
+Description: %s
+`,
+		prj.Manifest.Project.Name,
+		prj.Manifest.Project.Version,
+		debianArch,
+		strings.Join(prj.Manifest.Project.Authors, ", "),
+		prj.Manifest.Project.Name,
+	)
+
+	controlDir := filepath.Join(root, "DEBIAN")
+	expect(os.MkdirAll(controlDir, 0755), "Could not create", quote(controlDir))
+	expect(ioutil.WriteFile(filepath.Join(controlDir, "control"), []byte(control), 0644), "Could not write Debian control file")
+
+	binDir := filepath.Join(root, "usr", "bin")
+	expect(os.MkdirAll(binDir, 0755), "Could not create", quote(binDir))
+	for _, entry := range entries {
+		dst := filepath.Join(binDir, filepath.Base(entry.Dst))
+		content, err := ioutil.ReadFile(entry.Src)
+		expect(err, "Could not read", quote(entry.Src))
+		expect(ioutil.WriteFile(dst, content, entry.Perm), "Could not write", quote(dst))
+	}
+
+	debName := fmt.Sprintf("%s-%s-%s.deb", prj.Manifest.Project.Name, prj.Manifest.Project.Version, debianArch)
+	debPath := prj.path(releaseDir, debName)
+
+	cmd := exec.Command(dpkgDeb, "--build", root, debPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	expect(cmd.Run(), "`dpkg-deb` ended abnormally")
+
+	infoLog.Println(debPath)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A testCase is a single module under the project's test directory that
+// looks like it exports a test entry point.
+type testCase struct {
+	Name string // dotted module name, relative to testDir
+	Path string // absolute path to the .icl file
+}
+
+// A testResult records the outcome of compiling and running a single
+// testCase.
+type testResult struct {
+	Name     string
+	Passed   bool
+	Duration time.Duration
+	Output   string
+	Err      error
+}
+
+const testDir = "test"
+const defaultTimeout = 60 * time.Second
+
+// Test discovers modules under the project's test directory, compiles and
+// runs each with `clm`, and reports a pass/fail summary. It mirrors Go's
+// `cmd/go`'s test runner: tests run in parallel, can be sharded across CI
+// workers, and each gets its own scratch build directory.
+func (prj *Project) Test(args []string) {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	n := flags.Int("n", runtime.NumCPU(), "number of tests to build and run in parallel")
+	verbose := flags.Bool("v", false, "print each test's name and output as it runs (forces -n 1)")
+	keep := flags.Bool("k", false, "keep build artifacts in a temporary directory instead of removing them")
+	l := flags.Int("l", runtime.NumCPU(), "number of test binaries allowed to run concurrently")
+	shard := flags.Int("shard", 0, "index of the shard to run (0-based)")
+	shards := flags.Int("shards", 1, "total number of shards to split tests across")
+	run := flags.String("run", "", "only run tests whose name matches this regexp")
+	summary := flags.Bool("summary", false, "print a table of pass/fail counts and the slowest tests")
+	timeout := flags.Duration("timeout", defaultTimeout, "timeout for a single test run")
+	expect(flags.Parse(args), "Could not parse arguments")
+
+	prj.Unlit()
+
+	if *verbose {
+		*n = 1
+	}
+
+	cases, err := discoverTests(prj.path(testDir))
+	expect(err, "Could not discover tests")
+
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		expect(err, "Invalid -run pattern")
+		filtered := cases[:0]
+		for _, tc := range cases {
+			if re.MatchString(tc.Name) {
+				filtered = append(filtered, tc)
+			}
+		}
+		cases = filtered
+	}
+	if *shards > 1 {
+		filtered := cases[:0]
+		for _, tc := range cases {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(tc.Name))
+			if int(h.Sum32()%uint32(*shards)) == *shard {
+				filtered = append(filtered, tc)
+			}
+		}
+		cases = filtered
+	}
+
+	if len(cases) == 0 {
+		infoLog.Println("No tests found")
+		return
+	}
+
+	actionLog.Println("Running", len(cases), "tests")
+
+	results := make([]testResult, len(cases))
+	buildSem := make(chan struct{}, *n)
+	runSem := make(chan struct{}, *l)
+	var wg sync.WaitGroup
+	for i, tc := range cases {
+		i, tc := i, tc
+		wg.Add(1)
+		buildSem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-buildSem }()
+			results[i] = runTest(prj, tc, runSem, *keep, *verbose, *timeout)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, res := range results {
+		if !res.Passed {
+			failed++
+		}
+		if *verbose || !res.Passed {
+			status := "PASS"
+			if !res.Passed {
+				status = "FAIL"
+			}
+			infoLog.Printf("%s %s (%v)\n", status, res.Name, res.Duration.Round(time.Millisecond))
+			if *verbose || !res.Passed {
+				if res.Err != nil {
+					warningLog.Println(res.Err)
+				}
+				if strings.TrimSpace(res.Output) != "" {
+					fmt.Println(res.Output)
+				}
+			}
+		}
+	}
+
+	if *summary {
+		printTestSummary(results)
+	}
+
+	actionLog.Printf("%d passed, %d failed, %d total\n", len(results)-failed, failed, len(results))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// discoverTests walks the project's test directory for *.icl files whose
+// body defines a `Start` function or a `test`-prefixed function.
+func discoverTests(root string) ([]testCase, error) {
+	var cases []testCase
+
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".icl" {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !looksLikeTest(string(content)) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, strings.TrimSuffix(path, ".icl"))
+		if err != nil {
+			return err
+		}
+		name := slashToDot.Replace(rel)
+		cases = append(cases, testCase{Name: name, Path: path})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(cases, func(i, j int) bool { return cases[i].Name < cases[j].Name })
+	return cases, nil
+}
+
+func looksLikeTest(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "Start ") || strings.HasPrefix(line, "Start::") ||
+			strings.HasPrefix(line, "Start=") || strings.HasPrefix(line, "Start ::") {
+			return true
+		}
+		if strings.HasPrefix(line, "test") {
+			return true
+		}
+	}
+	return false
+}
+
+// runTest compiles a single test module into a scratch directory and runs
+// it, comparing its output against an optional `.expected` sibling file.
+func runTest(prj *Project, tc testCase, runSem chan struct{}, keep, verbose bool, timeout time.Duration) testResult {
+	start := time.Now()
+
+	build, err := ioutil.TempDir("", "cl-test-")
+	if err != nil {
+		return testResult{Name: tc.Name, Err: fmt.Errorf("could not create build directory: %w", err)}
+	}
+	if keep {
+		infoLog.Println("Keeping build directory", quote(build), "for", tc.Name)
+	} else {
+		defer os.RemoveAll(build)
+	}
+
+	exe := filepath.Join(build, "test")
+	args := prj.buildArgs("-I", prj.path(testDir), tc.Name, "-o", exe)
+
+	var buf bytes.Buffer
+	buildCmd := exec.Command("clm", args...)
+	buildCmd.Dir = prj.Root
+	buildCmd.Stdout = &buf
+	buildCmd.Stderr = &buf
+	if err := buildCmd.Run(); err != nil {
+		return testResult{Name: tc.Name, Duration: time.Since(start), Err: fmt.Errorf("`clm` failed: %w", err), Output: buf.String()}
+	}
+
+	runSem <- struct{}{}
+	defer func() { <-runSem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	runCmd := exec.CommandContext(ctx, exe)
+	runCmd.Stdout = &stdout
+	runCmd.Stderr = &stderr
+	runErr := runCmd.Run()
+
+	// Output keeps stdout and stderr together for diagnostics, but
+	// .expected only ever records stdout -- otherwise an incidental
+	// warning or GC message on stderr would fail an otherwise-correct test.
+	res := testResult{Name: tc.Name, Duration: time.Since(start), Output: stdout.String() + stderr.String(), Passed: runErr == nil}
+	if runErr != nil {
+		res.Err = fmt.Errorf("%s ended abnormally: %w", quote(tc.Name), runErr)
+		return res
+	}
+
+	expected := tc.Path[:len(tc.Path)-len(".icl")] + ".expected"
+	if want, err := ioutil.ReadFile(expected); err == nil {
+		if string(want) != stdout.String() {
+			res.Passed = false
+			res.Err = fmt.Errorf("output did not match %s", quote(expected))
+		}
+	}
+	return res
+}
+
+func printTestSummary(results []testResult) {
+	actionLog.Println("Summary")
+
+	sorted := make([]testResult, len(results))
+	copy(sorted, results)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Duration > sorted[j].Duration })
+
+	n := 5
+	if len(sorted) < n {
+		n = len(sorted)
+	}
+	infoLog.Println("Slowest tests:")
+	for _, res := range sorted[:n] {
+		infoLog.Printf("  %v  %s\n", res.Duration.Round(time.Millisecond), res.Name)
+	}
+}